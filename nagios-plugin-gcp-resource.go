@@ -1,41 +1,59 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"sort"
+	"strings"
 
 	//"strconv"
 	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3"
+	monitoringquery "cloud.google.com/go/monitoring/apiv3/v2"
 	googlepb "github.com/golang/protobuf/ptypes/timestamp"
 	flags "github.com/jessevdk/go-flags"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+const monitoringScope = "https://www.googleapis.com/auth/monitoring.read"
+
 type Options struct {
-	Project   string  `short:"g" long:"project"   required:"true"  description:"GCP project id." `
-	Auth      string  `short:"a" long:"auth"      required:"true"  default:"~/gcp_auth_key.json" description:"GCP authenticate key." `
-	Metric    string  `short:"m" long:"metric"    required:"true"  description:"Monitoring metric." `
-	Filter    string  `short:"f" long:"filter"    required:"false" default:""    description:"Filter query." `
-	Delay     int64   `short:"d" long:"delay"     required:"false" default:"4"   description:"Shift the acquisition period." `
-	Period    int64   `short:"p" long:"period"    required:"false" default:"5"   description:"Metric acquisition period." `
-	Evalution string  `short:"e" long:"evalution" required:"false" default:"MAX" description:"Metric evaluate type." `
-	Critical  float64 `short:"c" long:"critical"  required:"false" default:"0.0" description:"Critical threshold." `
-	Warning   float64 `short:"w" long:"warning"   required:"false" default:"0.0" description:"Warning threshold." `
-	Verbose   []bool  `short:"v" long:"verbose"   required:"false" description:"Verbose option." `
+	Project       string  `short:"g" long:"project"        required:"true"  description:"GCP project id." `
+	Auth          string  `short:"a" long:"auth"           required:"true"  default:"~/gcp_auth_key.json" description:"GCP authenticate key." `
+	Metric        string  `short:"m" long:"metric"         required:"false" description:"Monitoring metric." `
+	Filter        string  `short:"f" long:"filter"         required:"false" default:""    description:"Filter query." `
+	QueryLanguage string  `short:"q" long:"query-language" required:"false" default:"filter" description:"Query language to use (filter, mql, promql)." `
+	Query         string  `long:"query"                    required:"false" default:""    description:"Raw MQL or PromQL query." `
+	Delay         int64   `short:"d" long:"delay"          required:"false" default:"4"   description:"Shift the acquisition period." `
+	Period        int64   `short:"p" long:"period"         required:"false" default:"5"   description:"Metric acquisition period." `
+	Serve         string  `long:"serve"                    required:"false" default:""    description:"Run as a daemon exposing a Prometheus /metrics endpoint on this address (e.g. :9100) instead of a one-shot check." `
+	Config        string  `long:"config"                   required:"false" default:""    description:"Run every check defined in this YAML file instead of the single --metric check." `
+	Evalution     string  `short:"e" long:"evalution"      required:"false" default:"MAX" description:"Metric evaluate type (LAST, SUM, MIN, MAX, AVG, COUNT, P50, P90, P95, P99, PERCENTILE, RATE, DELTA)." `
+	Percentile    float64 `long:"percentile"               required:"false" default:"95"  description:"Percentile to compute when --evalution is PERCENTILE." `
+	Critical      float64 `short:"c" long:"critical"       required:"false" default:"0.0" description:"Critical threshold." `
+	Warning       float64 `short:"w" long:"warning"        required:"false" default:"0.0" description:"Warning threshold." `
+	LabelKeys     string  `long:"label-keys"               required:"false" default:""    description:"Ordered, comma-separated resource/metric label keys to concatenate into the metric name." `
+	ExcludeLabels string  `long:"exclude-labels"           required:"false" default:""    description:"Comma-separated label keys to drop before naming." `
+	GroupBy       string  `long:"group-by"                 required:"false" default:""    description:"Fold all matched series into one via SUM, AVG or MAX before thresholding." `
+	Verbose       []bool  `short:"v" long:"verbose"        required:"false" description:"Verbose option." `
 }
 
 type Metric struct {
-    Name string
+	Name  string
 	Value float64
 }
 
 func main() {
 	message := ""
-	
+
 	// 引数解析処理
 	var opts Options
 	parser := flags.NewParser(&opts, flags.IgnoreUnknown)
@@ -48,92 +66,417 @@ func main() {
 	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", opts.Auth)
 
 	ctx := context.Background()
+
+	if len(opts.Serve) != 0 {
+		serve(ctx, opts)
+		return
+	}
+
+	if len(opts.Config) != 0 {
+		runConfig(ctx, opts)
+		return
+	}
+
+	var metrics []Metric
+	switch opts.QueryLanguage {
+	case "", "filter":
+		if len(opts.Metric) == 0 {
+			output(UNKNOWN, "--metric is required when --query-language is \"filter\".")
+		}
+		metrics, err = fetchFilterMetrics(ctx, opts)
+	case "mql":
+		if len(opts.Query) == 0 {
+			output(UNKNOWN, "--query is required when --query-language is \"mql\".")
+		}
+		metrics, err = fetchMQLMetrics(ctx, opts)
+	case "promql":
+		if len(opts.Query) == 0 {
+			output(UNKNOWN, "--query is required when --query-language is \"promql\".")
+		}
+		metrics, err = fetchPromQLMetrics(ctx, opts)
+	default:
+		output(UNKNOWN, fmt.Sprintf("Unknown query language %q.", opts.QueryLanguage))
+	}
+	if err != nil {
+		verbose(opts.Verbose, err)
+		output(UNKNOWN, "Failed to fetch time series.")
+	}
+	verbose(opts.Verbose, metrics)
+
+	metrics = foldMetrics(metrics, opts.GroupBy)
+
+	if len(metrics) == 0 {
+		output(UNKNOWN, "Time series is empty.")
+	}
+
+	// Metric descriptors rarely carry bounds, but they do carry the unit.
+	uom := ""
+	if opts.QueryLanguage == "" || opts.QueryLanguage == "filter" {
+		if u, err := fetchMetricUnit(ctx, opts); err == nil {
+			uom = u
+		} else {
+			verbose(opts.Verbose, err)
+		}
+	}
+
+	// Init status and message
+	status := OK
+	message = fmt.Sprintf("Everything is OK")
+	perfdata := "|"
+	// Parse all metrics
+	for _, element := range metrics {
+		name := element.Name
+		value := element.Value
+
+		// Compare metric to optionnal thresholds
+		if opts.Critical > 0.0 && value >= opts.Critical && (status == OK || status == WARNING) {
+			status = CRITICAL
+			message = fmt.Sprintf("%s %s value: %d over %d", name, opts.Evalution, int(value), int(opts.Critical))
+		} else if opts.Warning > 0.0 && value >= opts.Warning && status == OK {
+			status = WARNING
+			message = fmt.Sprintf("%s %s value: %d over %d", name, opts.Evalution, int(value), int(opts.Warning))
+		}
+
+		// Set performance data, labelling it with the aggregation that produced it
+		label := fmt.Sprintf("%s_%s", name, strings.ToLower(opts.Evalution))
+		if name == "" {
+			label = strings.ToLower(opts.Evalution)
+		}
+		perfdata = perfdata + fmt.Sprintf("%s=%f%s;%d;%d;; ", quotePerfdataLabel(label), value, uom, int(opts.Warning), int(opts.Critical))
+	}
+
+	output(status, message+perfdata)
+}
+
+// quotePerfdataLabel quotes a perfdata label per the Nagios plugin spec: a
+// label containing spaces must be wrapped in single quotes, with any single
+// quote it already contains doubled.
+func quotePerfdataLabel(label string) string {
+	if !strings.Contains(label, " ") {
+		return label
+	}
+	return "'" + strings.ReplaceAll(label, "'", "''") + "'"
+}
+
+// foldMetrics combines every matched series into one via the requested
+// aggregation before thresholds are compared, for callers that want a single
+// "instances down" style check rather than one result per series.
+func foldMetrics(metrics []Metric, groupBy string) []Metric {
+	if groupBy == "" || len(metrics) == 0 {
+		return metrics
+	}
+
+	var value float64
+	switch groupBy {
+	case "SUM":
+		for _, metric := range metrics {
+			value += metric.Value
+		}
+	case "AVG":
+		for _, metric := range metrics {
+			value += metric.Value
+		}
+		value /= float64(len(metrics))
+	case "MAX":
+		value = metrics[0].Value
+		for _, metric := range metrics[1:] {
+			if metric.Value > value {
+				value = metric.Value
+			}
+		}
+	default:
+		return metrics
+	}
+	return []Metric{{Name: strings.ToLower(groupBy), Value: value}}
+}
+
+// fetchMetricUnit looks up the unit of measure (uom) for --metric from its
+// MetricDescriptor, for display in perfdata.
+func fetchMetricUnit(ctx context.Context, opts Options) (string, error) {
+	if len(opts.Metric) == 0 {
+		return "", nil
+	}
 	c, err := monitoring.NewMetricClient(ctx)
 	if err != nil {
-		message = fmt.Sprintf("GCP SDK Client request failed (%s)", err)
-		output(UNKNOWN, message)
+		return "", err
+	}
+	descriptor, err := c.GetMetricDescriptor(ctx, &monitoringpb.GetMetricDescriptorRequest{
+		Name: fmt.Sprintf("projects/%s/metricDescriptors/%s", opts.Project, opts.Metric),
+	})
+	if err != nil {
+		return "", err
+	}
+	return descriptor.GetUnit(), nil
+}
+
+// runConfig runs every check defined in a --config file through a Runner and
+// aggregates the results into a single Nagios status and perfdata line.
+func runConfig(ctx context.Context, opts Options) {
+	cfg, err := loadConfig(opts.Config)
+	if err != nil {
+		output(UNKNOWN, fmt.Sprintf("Failed to read config %q (%s)", opts.Config, err))
+	}
+
+	runner := NewRunner(opts, cfg)
+	results, err := runner.Run(ctx)
+	if err != nil {
+		verbose(opts.Verbose, err)
+		output(UNKNOWN, "Failed to run checks.")
 	}
+	verbose(opts.Verbose, results)
 
-	var filter string = fmt.Sprintf("metric.type = \"%s\" ", opts.Metric)
-	if len(opts.Filter) != 0 {
-		filter += fmt.Sprintf("AND %s ", opts.Filter)
+	if len(results) == 0 {
+		output(UNKNOWN, "Time series is empty.")
 	}
+
+	status := OK
+	problems := []string{}
+	perfdata := "|"
+	for _, result := range results {
+		if result.Err != nil {
+			status = UNKNOWN
+			problems = append(problems, fmt.Sprintf("%s: %s", result.Check.Metric, result.Err))
+			continue
+		}
+		if result.Status > status {
+			status = result.Status
+		}
+		if result.Status != OK {
+			problems = append(problems, fmt.Sprintf("%s %s value: %d", result.Name, result.Check.Evaluation, int(result.Value)))
+		}
+		perfdata += fmt.Sprintf("%s=%f%s;%d;%d ", quotePerfdataLabel(result.Name), result.Value, result.Check.Unit, int(result.Check.Warn), int(result.Check.Crit))
+	}
+
+	message := "Everything is OK"
+	if len(problems) != 0 {
+		message = strings.Join(problems, ", ")
+	}
+	output(status, message+perfdata)
+}
+
+// fetchFilterMetrics is the historical code path: a single metric.type filter
+// evaluated through ListTimeSeries.
+func fetchFilterMetrics(ctx context.Context, opts Options) ([]Metric, error) {
+	c, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GCP SDK Client request failed (%s)", err)
+	}
+
+	filter := metricFilter(opts.Metric, opts.Filter)
 	verbose(opts.Verbose, filter)
 
+	req := listTimeSeriesRequest(opts.Project, filter, opts.Delay, opts.Period)
+
+	metrics := []Metric{}
+	it := c.ListTimeSeries(ctx, req)
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		verbose(opts.Verbose, resp.Metric)
+		verbose(opts.Verbose, resp.Resource)
+		metric_value := evaluate(opts.Evalution, resp.ValueType.String(), resp.Points, opts.Percentile)
+		verbose(opts.Verbose, metric_value)
+
+		// Merge resource and metric labels so no label is silently dropped,
+		// then prune the noisy/excluded ones before naming the series.
+		labels := mergeLabels(resp.Resource.GetLabels(), resp.Metric.GetLabels())
+		delete(labels, "project_id")
+		for _, key := range splitCSV(opts.ExcludeLabels) {
+			delete(labels, key)
+		}
+		metric_name := nameFromLabels(opts.LabelKeys, labels)
+		// Append metric to previous ones
+		metrics = append(metrics, Metric{metric_name, metric_value})
+	}
+	return metrics, nil
+}
+
+// metricFilter builds a Monitoring API filter for a single metric type, with
+// an optional extra filter clause ANDed on.
+func metricFilter(metricType, extra string) string {
+	filter := fmt.Sprintf("metric.type = \"%s\" ", metricType)
+	if len(extra) != 0 {
+		filter += fmt.Sprintf("AND %s ", extra)
+	}
+	return filter
+}
+
+// listTimeSeriesRequest builds the ListTimeSeriesRequest shared by every
+// filter-based check: fetchFilterMetrics, Runner.runCheck and server.poll all
+// query the same [now-delay-period, now-delay] window.
+func listTimeSeriesRequest(project, filter string, delay, period int64) *monitoringpb.ListTimeSeriesRequest {
 	unixNow := time.Now().Unix()
-	req := &monitoringpb.ListTimeSeriesRequest{
-		Name:   "projects/" + opts.Project,
+	return &monitoringpb.ListTimeSeriesRequest{
+		Name:   "projects/" + project,
 		Filter: filter,
 		Interval: &monitoringpb.TimeInterval{
 			EndTime: &googlepb.Timestamp{
-				Seconds: unixNow - (opts.Delay * 60),
+				Seconds: unixNow - (delay * 60),
 			},
 			StartTime: &googlepb.Timestamp{
-				Seconds: unixNow - ((opts.Delay + opts.Period) * 60),
+				Seconds: unixNow - ((delay + period) * 60),
 			},
 		},
 	}
-	
+}
+
+// nameFromLabels builds a series' metric name from its labels: the ordered
+// label_keys if given (e.g. "instance_name,zone" -> "my-vm.europe-west1-b"),
+// otherwise every remaining label sorted by key, so the result is
+// deterministic instead of depending on Go's map iteration order.
+func nameFromLabels(labelKeysCSV string, labels map[string]string) string {
+	keys := splitCSV(labelKeysCSV)
+	if len(keys) == 0 {
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, labels[key])
+	}
+	return strings.Join(parts, ".")
+}
+
+// splitCSV splits a comma-separated flag value into its trimmed parts,
+// returning nil for an empty string.
+func splitCSV(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return parts
+}
+
+// fetchMQLMetrics evaluates a Monitoring Query Language query. Unlike
+// ListTimeSeries, QueryTimeSeries returns row-oriented TimeSeriesData, where
+// each row carries its own label values and a PointData slice instead of the
+// fixed TimeSeries/Point shape used by the filter API.
+func fetchMQLMetrics(ctx context.Context, opts Options) ([]Metric, error) {
+	c, err := monitoringquery.NewQueryClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GCP SDK Client request failed (%s)", err)
+	}
+
+	req := &monitoringpb.QueryTimeSeriesRequest{
+		Name:  "projects/" + opts.Project,
+		Query: opts.Query,
+	}
+	verbose(opts.Verbose, req.Query)
+
 	metrics := []Metric{}
-	length := 0
-	it := c.ListTimeSeries(ctx, req)
+	it := c.QueryTimeSeries(ctx, req)
 	for {
 		resp, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			verbose(opts.Verbose, err)
-			output(UNKNOWN, "Failed to fetch time series.")
+			return nil, err
+		}
+		verbose(opts.Verbose, resp.LabelValues)
+		metric_value, err := evaluateRows(opts.Evalution, resp.PointData, opts.Percentile)
+		if err != nil {
+			return nil, err
 		}
-		verbose(opts.Verbose, resp.Metric)
-		verbose(opts.Verbose, resp.Resource)
-		metric_value := evaluate(opts.Evalution, resp.ValueType.String(), resp.Points)
 		verbose(opts.Verbose, metric_value)
-		length += len(resp.Points)
-		
-		// Get all labels and remove project_id if present
-		labels := resp.Resource.GetLabels()
-		if _, ok := labels["project_id"]; ok {
-			delete(labels, "project_id");
-		}
-		// Get only last remaining label for value attribution
-		metric_name := ""
-		for _, label := range labels {
-			metric_name = label
+
+		// MQL rows don't carry named labels directly, only a LabelValues
+		// slice positional to the query's `| group_by` keys, so there are no
+		// real label names to key --label-keys/--exclude-labels off. Still,
+		// route through the same naming helper and keep every label instead
+		// of arbitrarily keeping only the last one.
+		labels := map[string]string{}
+		for i, label := range resp.LabelValues {
+			if s := label.GetStringValue(); s != "" {
+				labels[fmt.Sprintf("label%d", i)] = s
+			}
 		}
-		// Append metric to previous ones
-		metrics = append(metrics, Metric{metric_name,metric_value})
+		for _, key := range splitCSV(opts.ExcludeLabels) {
+			delete(labels, key)
+		}
+		metric_name := nameFromLabels(opts.LabelKeys, labels)
+		metrics = append(metrics, Metric{metric_name, metric_value})
 	}
-	verbose(opts.Verbose, metrics)
+	return metrics, nil
+}
 
-	if length == 0 {
-		output(UNKNOWN, "Time series is empty.")
+// fetchPromQLMetrics evaluates the query against the Cloud Monitoring PromQL
+// endpoint. There is no generated protobuf client for it yet, so it is called
+// over the same REST surface `gcloud monitoring` uses under the hood.
+func fetchPromQLMetrics(ctx context.Context, opts Options) ([]Metric, error) {
+	client, err := google.DefaultClient(ctx, monitoringScope)
+	if err != nil {
+		return nil, fmt.Errorf("GCP SDK Client request failed (%s)", err)
 	}
 
-	// Init status and message
-	status := OK
-	message = fmt.Sprintf("Everything is OK")
-	perfdata := "|"
-	// Parse all metrics
-	for _, element := range metrics {
-		name := element.Name
-		value := element.Value
-		
-		// Compare metric to optionnal thresholds
-		if opts.Critical > 0.0 && value >= opts.Critical && (status == OK || status == WARNING) {
-			status = CRITICAL
-			message = fmt.Sprintf("%s %s value: %d over %d", name, opts.Evalution, int(value), int(opts.Critical))
-		} else if opts.Warning > 0.0 && value >= opts.Warning && status == OK {
-			status = WARNING
-			message = fmt.Sprintf("%s %s value: %d over %d", name, opts.Evalution, int(value), int(opts.Warning))
+	url := fmt.Sprintf(
+		"https://monitoring.googleapis.com/v1/projects/%s/location/global/prometheus/api/v1/query?query=%s",
+		opts.Project, opts.Query,
+	)
+	verbose(opts.Verbose, url)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed promQLResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.Status != "success" {
+		return nil, fmt.Errorf("promql query failed: %s", string(body))
+	}
+
+	metrics := []Metric{}
+	for _, result := range parsed.Data.Result {
+		labels := map[string]string{}
+		for k, v := range result.Metric {
+			labels[k] = v
+		}
+		for _, key := range splitCSV(opts.ExcludeLabels) {
+			delete(labels, key)
+		}
+		metric_name := nameFromLabels(opts.LabelKeys, labels)
+
+		var metric_value float64
+		if len(result.Value) == 2 {
+			fmt.Sscanf(fmt.Sprintf("%v", result.Value[1]), "%f", &metric_value)
 		}
-		
-		// Set performance data
-		perfdata = perfdata + fmt.Sprintf("%s=%f;%d;%d ", name, value, int(opts.Warning), int(opts.Critical))
+		metrics = append(metrics, Metric{metric_name, metric_value})
 	}
-	
-	output(status, message+perfdata)
+	return metrics, nil
+}
+
+// promQLResponse mirrors the subset of Prometheus' HTTP API response format
+// (https://prometheus.io/docs/prometheus/latest/querying/api/) that the Cloud
+// Monitoring PromQL endpoint reuses.
+type promQLResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
 }
 
 const (
@@ -160,7 +503,7 @@ func output(status int, message string) {
 	os.Exit(status)
 }
 
-func evaluate(evaluateType string, valueType string, points []*monitoringpb.Point) float64 {
+func evaluate(evaluateType string, valueType string, points []*monitoringpb.Point, percentile float64) float64 {
 	var ret float64
 	switch evaluateType {
 	case "LAST":
@@ -169,6 +512,13 @@ func evaluate(evaluateType string, valueType string, points []*monitoringpb.Poin
 		for _, point := range points {
 			ret += getFloatValue(valueType, point.GetValue())
 		}
+	case "MIN":
+		ret = math.MaxFloat64
+		for _, point := range points {
+			if current := getFloatValue(valueType, point.GetValue()); current < ret {
+				ret = current
+			}
+		}
 	case "MAX":
 		var current float64
 		for _, point := range points {
@@ -178,10 +528,114 @@ func evaluate(evaluateType string, valueType string, points []*monitoringpb.Poin
 			}
 			ret = current
 		}
+	case "AVG":
+		for _, point := range points {
+			ret += getFloatValue(valueType, point.GetValue())
+		}
+		ret /= float64(len(points))
+	case "COUNT":
+		ret = float64(len(points))
+	case "P50", "P90", "P95", "P99":
+		rank := map[string]float64{"P50": 50, "P90": 90, "P95": 95, "P99": 99}[evaluateType]
+		ret = getPercentileValue(valueType, points[0].GetValue(), rank)
+	case "PERCENTILE":
+		ret = getPercentileValue(valueType, points[0].GetValue(), percentile)
+	case "RATE":
+		if newer, older, deltaSeconds, ok := deltaWindow(valueType, points); ok && deltaSeconds != 0 {
+			ret = (newer - older) / deltaSeconds
+		}
+	case "DELTA":
+		if newer, older, _, ok := deltaWindow(valueType, points); ok {
+			ret = newer - older
+		}
 	}
 	return ret
 }
 
+// deltaWindow pulls the values and elapsed seconds between the most recent
+// point and the one before it, as used by the RATE and DELTA aligners.
+// ListTimeSeries returns points newest-first, matching ALIGN_RATE/ALIGN_DELTA
+// which both compare a point to its immediate predecessor.
+func deltaWindow(valueType string, points []*monitoringpb.Point) (newer, older, deltaSeconds float64, ok bool) {
+	if len(points) < 2 {
+		return 0, 0, 0, false
+	}
+	newer = getFloatValue(valueType, points[0].GetValue())
+	older = getFloatValue(valueType, points[1].GetValue())
+	deltaSeconds = float64(points[0].GetInterval().GetEndTime().GetSeconds() - points[1].GetInterval().GetEndTime().GetSeconds())
+	return newer, older, deltaSeconds, true
+}
+
+// evaluateRows is the MQL counterpart of evaluate: MQL returns row-oriented
+// TimeSeriesData, so each point carries its value directly as a
+// monitoringpb.TypedValue rather than being wrapped in a Point. It mirrors
+// evaluate's evaluation types where the row shape supports them, and returns
+// an error for the ones it doesn't (rather than silently returning 0), since
+// a silent 0 can mask a real alert.
+func evaluateRows(evaluateType string, points []*monitoringpb.TimeSeriesData_PointData, percentile float64) (float64, error) {
+	switch evaluateType {
+	case "LAST":
+		return rowValue(points[0]), nil
+	case "SUM":
+		var ret float64
+		for _, point := range points {
+			ret += rowValue(point)
+		}
+		return ret, nil
+	case "MIN":
+		ret := math.MaxFloat64
+		for _, point := range points {
+			if current := rowValue(point); current < ret {
+				ret = current
+			}
+		}
+		return ret, nil
+	case "MAX":
+		var ret, current float64
+		for _, point := range points {
+			current = rowValue(point)
+			if current < ret {
+				continue
+			}
+			ret = current
+		}
+		return ret, nil
+	case "AVG":
+		var ret float64
+		for _, point := range points {
+			ret += rowValue(point)
+		}
+		return ret / float64(len(points)), nil
+	case "COUNT":
+		return float64(len(points)), nil
+	case "RATE", "DELTA":
+		if len(points) < 2 {
+			return 0, nil
+		}
+		newer, older := rowValue(points[0]), rowValue(points[1])
+		if evaluateType == "DELTA" {
+			return newer - older, nil
+		}
+		deltaSeconds := float64(points[0].GetTimeInterval().GetEndTime().GetSeconds() - points[1].GetTimeInterval().GetEndTime().GetSeconds())
+		if deltaSeconds == 0 {
+			return 0, nil
+		}
+		return (newer - older) / deltaSeconds, nil
+	case "P50", "P90", "P95", "P99", "PERCENTILE":
+		return 0, fmt.Errorf("evalution %q needs bucket data MQL rows don't expose here; compute it in the query instead (e.g. `| align percentile(%g)`)", evaluateType, percentile)
+	default:
+		return 0, fmt.Errorf("unknown evalution type %q", evaluateType)
+	}
+}
+
+// rowValue reads the first value off an MQL PointData row.
+func rowValue(point *monitoringpb.TimeSeriesData_PointData) float64 {
+	if len(point.Values) == 0 {
+		return 0
+	}
+	return point.Values[0].GetDoubleValue()
+}
+
 func getFloatValue(valueType string, typedValue *monitoringpb.TypedValue) float64 {
 	var ret float64
 	switch valueType {
@@ -197,6 +651,81 @@ func getFloatValue(valueType string, typedValue *monitoringpb.TypedValue) float6
 	return ret
 }
 
+// getPercentileValue is like getFloatValue but, for DISTRIBUTION points,
+// returns the requested percentile instead of the mean. Other value types
+// have no buckets to interpolate, so they fall back to getFloatValue.
+func getPercentileValue(valueType string, typedValue *monitoringpb.TypedValue, percentile float64) float64 {
+	if valueType != "DISTRIBUTION" {
+		return getFloatValue(valueType, typedValue)
+	}
+	return distributionPercentile(typedValue.GetDistributionValue(), percentile)
+}
+
+// distributionPercentile walks a distribution's cumulative bucket counts to
+// find the bucket containing the target rank, then linearly interpolates
+// within that bucket's bounds.
+func distributionPercentile(dist *distributionpb.Distribution, percentile float64) float64 {
+	counts := dist.GetBucketCounts()
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return dist.GetMean()
+	}
+
+	targetRank := percentile / 100.0 * float64(total)
+	var cumulative int64
+	for i, count := range counts {
+		if float64(cumulative+count) >= targetRank {
+			lower, upper := bucketBounds(dist.GetBucketOptions(), i)
+			if count == 0 || math.IsInf(lower, -1) || math.IsInf(upper, 1) {
+				return lower
+			}
+			frac := (targetRank - float64(cumulative)) / float64(count)
+			return lower + frac*(upper-lower)
+		}
+		cumulative += count
+	}
+	return dist.GetMean()
+}
+
+// bucketBounds returns the [lower, upper) bounds of bucket i for the given
+// BucketOptions. Bucket 0 is the underflow bucket and the last bucket is the
+// overflow bucket, both unbounded on one side.
+func bucketBounds(opts *distributionpb.Distribution_BucketOptions, i int) (float64, float64) {
+	switch b := opts.GetOptions().(type) {
+	case *distributionpb.Distribution_BucketOptions_LinearBuckets:
+		l := b.LinearBuckets
+		if i == 0 {
+			return math.Inf(-1), l.GetOffset()
+		}
+		if i > int(l.GetNumFiniteBuckets()) {
+			return l.GetOffset() + l.GetWidth()*float64(l.GetNumFiniteBuckets()), math.Inf(1)
+		}
+		return l.GetOffset() + l.GetWidth()*float64(i-1), l.GetOffset() + l.GetWidth()*float64(i)
+	case *distributionpb.Distribution_BucketOptions_ExponentialBuckets:
+		e := b.ExponentialBuckets
+		if i == 0 {
+			return math.Inf(-1), e.GetScale()
+		}
+		if i > int(e.GetNumFiniteBuckets()) {
+			return e.GetScale() * math.Pow(e.GetGrowthFactor(), float64(e.GetNumFiniteBuckets())), math.Inf(1)
+		}
+		return e.GetScale() * math.Pow(e.GetGrowthFactor(), float64(i-1)), e.GetScale() * math.Pow(e.GetGrowthFactor(), float64(i))
+	case *distributionpb.Distribution_BucketOptions_ExplicitBuckets:
+		bounds := b.ExplicitBuckets.GetBounds()
+		if i == 0 {
+			return math.Inf(-1), bounds[0]
+		}
+		if i >= len(bounds) {
+			return bounds[len(bounds)-1], math.Inf(1)
+		}
+		return bounds[i-1], bounds[i]
+	}
+	return 0, 0
+}
+
 func verbose(flag []bool, value interface{}) {
 	if len(flag) == 0 {
 		return
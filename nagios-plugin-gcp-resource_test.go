@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func explicitBucketOptions(bounds []float64) *distributionpb.Distribution_BucketOptions {
+	return &distributionpb.Distribution_BucketOptions{
+		Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
+			ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{
+				Bounds: bounds,
+			},
+		},
+	}
+}
+
+func TestBucketBoundsExplicitOverflow(t *testing.T) {
+	opts := explicitBucketOptions([]float64{1, 2, 3})
+
+	// Bucket index len(bounds) is the overflow bucket and must not index
+	// past the end of bounds.
+	lower, upper := bucketBounds(opts, 3)
+	if lower != 3 || !math.IsInf(upper, 1) {
+		t.Fatalf("bucketBounds(overflow) = (%v, %v), want (3, +Inf)", lower, upper)
+	}
+}
+
+func TestDistributionPercentileLandsInOverflowBucket(t *testing.T) {
+	dist := &distributionpb.Distribution{
+		BucketOptions: explicitBucketOptions([]float64{1, 2, 3}),
+		// underflow (<1), [1,2), [2,3), overflow (>=3)
+		BucketCounts: []int64{0, 1, 1, 97},
+	}
+
+	got := distributionPercentile(dist, 99)
+	if math.IsInf(got, 0) || math.IsNaN(got) {
+		t.Fatalf("distributionPercentile(P99) = %v, want a finite value", got)
+	}
+}
+
+func TestEvaluateRowsRejectsPercentile(t *testing.T) {
+	_, err := evaluateRows("P95", []*monitoringpb.TimeSeriesData_PointData{}, 95)
+	if err == nil {
+		t.Fatal("evaluateRows(\"P95\", ...) = nil error, want an error since MQL rows carry no bucket data")
+	}
+}
+
+func TestQuotePerfdataLabel(t *testing.T) {
+	cases := []struct {
+		label string
+		want  string
+	}{
+		{"my-vm", "my-vm"},
+		{"us-central1-a", "us-central1-a"},
+		{"my vm", "'my vm'"},
+		{"it's a vm", "'it''s a vm'"},
+	}
+	for _, c := range cases {
+		if got := quotePerfdataLabel(c.label); got != c.want {
+			t.Errorf("quotePerfdataLabel(%q) = %q, want %q", c.label, got, c.want)
+		}
+	}
+}
+
+func TestNameFromLabels(t *testing.T) {
+	labels := map[string]string{"instance_name": "my-vm", "zone": "europe-west1-b"}
+
+	if got, want := nameFromLabels("instance_name,zone", labels), "my-vm.europe-west1-b"; got != want {
+		t.Errorf("nameFromLabels(ordered keys) = %q, want %q", got, want)
+	}
+
+	// With no label_keys, every label is used, sorted by key so the result
+	// is deterministic regardless of map iteration order.
+	if got, want := nameFromLabels("", labels), "my-vm.europe-west1-b"; got != want {
+		t.Errorf("nameFromLabels(no keys) = %q, want %q", got, want)
+	}
+}
+
+func TestFoldMetrics(t *testing.T) {
+	metrics := []Metric{{Name: "a", Value: 1}, {Name: "b", Value: 3}, {Name: "c", Value: 2}}
+
+	if got := foldMetrics(metrics, ""); len(got) != 3 {
+		t.Errorf("foldMetrics(groupBy=\"\") = %v, want the metrics unchanged", got)
+	}
+
+	sum := foldMetrics(metrics, "SUM")
+	if len(sum) != 1 || sum[0].Value != 6 {
+		t.Errorf("foldMetrics(SUM) = %v, want a single metric with value 6", sum)
+	}
+
+	avg := foldMetrics(metrics, "AVG")
+	if len(avg) != 1 || avg[0].Value != 2 {
+		t.Errorf("foldMetrics(AVG) = %v, want a single metric with value 2", avg)
+	}
+
+	max := foldMetrics(metrics, "MAX")
+	if len(max) != 1 || max[0].Value != 3 {
+		t.Errorf("foldMetrics(MAX) = %v, want a single metric with value 3", max)
+	}
+}
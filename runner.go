@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxWorkers bounds how many checks a Runner evaluates concurrently against
+// the Monitoring API, regardless of how many checks a config defines.
+const maxWorkers = 8
+
+// Check is a single entry of a --config file: one metric, its evaluation and
+// thresholds, and how to turn its labels into a perfdata name.
+type Check struct {
+	Metric       string   `yaml:"metric"`
+	Filter       string   `yaml:"filter"`
+	Evaluation   string   `yaml:"evaluation"`
+	Percentile   float64  `yaml:"percentile"`
+	Warn         float64  `yaml:"warn"`
+	Crit         float64  `yaml:"crit"`
+	Unit         string   `yaml:"unit"`
+	LabelKeys    []string `yaml:"label_keys"`
+	NameTemplate string   `yaml:"metric_name"`
+}
+
+// Config is the top-level shape of a --config file.
+type Config struct {
+	Checks []Check `yaml:"checks"`
+}
+
+// Result is one evaluated time series: a Check can fan out into several
+// Results, one per series it matches.
+type Result struct {
+	Check  Check
+	Name   string
+	Value  float64
+	Status int
+	Err    error
+}
+
+// Runner executes every Check in a Config against the Monitoring API using a
+// bounded worker pool; runConfig aggregates its Results into Nagios status +
+// perfdata.
+type Runner struct {
+	opts   Options
+	checks []Check
+	client *monitoring.MetricClient
+}
+
+func loadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func NewRunner(opts Options, cfg Config) *Runner {
+	return &Runner{opts: opts, checks: cfg.Checks}
+}
+
+// Run evaluates every configured check concurrently and returns one Result
+// per matched time series, in no particular order.
+func (r *Runner) Run(ctx context.Context) ([]Result, error) {
+	c, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GCP SDK Client request failed (%s)", err)
+	}
+	r.client = c
+
+	workers := len(r.checks)
+	if workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers == 0 {
+		return nil, nil
+	}
+
+	jobs := make(chan Check)
+	batches := make(chan []Result, len(r.checks))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				batches <- r.runCheck(ctx, check)
+			}
+		}()
+	}
+	go func() {
+		for _, check := range r.checks {
+			jobs <- check
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	results := []Result{}
+	for batch := range batches {
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+// runCheck evaluates a single Check, returning one Result per matched series.
+func (r *Runner) runCheck(ctx context.Context, check Check) []Result {
+	evaluation := check.Evaluation
+	if evaluation == "" {
+		evaluation = "MAX"
+	}
+	percentile := check.Percentile
+	if percentile == 0 {
+		percentile = r.opts.Percentile
+	}
+
+	filter := metricFilter(check.Metric, check.Filter)
+	req := listTimeSeriesRequest(r.opts.Project, filter, r.opts.Delay, r.opts.Period)
+
+	results := []Result{}
+	it := r.client.ListTimeSeries(ctx, req)
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return []Result{{Check: check, Status: UNKNOWN, Err: err}}
+		}
+
+		labels := mergeLabels(resp.Resource.GetLabels(), resp.Metric.GetLabels())
+		value := evaluate(evaluation, resp.ValueType.String(), resp.Points, percentile)
+		results = append(results, Result{
+			Check:  check,
+			Name:   metricName(check, labels),
+			Value:  value,
+			Status: statusFor(value, check.Warn, check.Crit),
+		})
+	}
+	return results
+}
+
+func statusFor(value, warn, crit float64) int {
+	switch {
+	case crit > 0.0 && value >= crit:
+		return CRITICAL
+	case warn > 0.0 && value >= warn:
+		return WARNING
+	default:
+		return OK
+	}
+}
+
+// metricName derives the perfdata identifier for a series: the config's Go
+// template if given (e.g. "{{.instance_name}}.{{.zone}}"), otherwise the
+// ordered label_keys joined with dots.
+func metricName(check Check, labels map[string]string) string {
+	if check.NameTemplate != "" {
+		tmpl, err := template.New("metric_name").Parse(check.NameTemplate)
+		if err == nil {
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, labels); err == nil {
+				return buf.String()
+			}
+		}
+	}
+
+	parts := make([]string, 0, len(check.LabelKeys))
+	for _, key := range check.LabelKeys {
+		parts = append(parts, labels[key])
+	}
+	return strings.Join(parts, ".")
+}
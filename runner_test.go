@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestMetricNameTemplate(t *testing.T) {
+	check := Check{NameTemplate: "{{.instance_name}}.{{.zone}}"}
+	labels := map[string]string{"instance_name": "my-vm", "zone": "europe-west1-b"}
+
+	if got, want := metricName(check, labels), "my-vm.europe-west1-b"; got != want {
+		t.Errorf("metricName(template) = %q, want %q", got, want)
+	}
+}
+
+func TestMetricNameFallsBackToLabelKeys(t *testing.T) {
+	check := Check{LabelKeys: []string{"instance_name", "zone"}}
+	labels := map[string]string{"instance_name": "my-vm", "zone": "europe-west1-b"}
+
+	if got, want := metricName(check, labels), "my-vm.europe-west1-b"; got != want {
+		t.Errorf("metricName(no template) = %q, want %q", got, want)
+	}
+}
+
+func TestMetricNameInvalidTemplateFallsBackToLabelKeys(t *testing.T) {
+	check := Check{NameTemplate: "{{.instance_name", LabelKeys: []string{"instance_name"}}
+	labels := map[string]string{"instance_name": "my-vm"}
+
+	if got, want := metricName(check, labels), "my-vm"; got != want {
+		t.Errorf("metricName(invalid template) = %q, want %q", got, want)
+	}
+}
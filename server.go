@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+)
+
+// server polls the configured GCP metric on a timer and re-exports it as a
+// Prometheus gauge, replacing the cold-start latency of one-shot
+// check_gcp_resource invocations with a long-running scrape target.
+type server struct {
+	opts     Options
+	registry *prometheus.Registry
+
+	mu     sync.Mutex
+	gauges map[string]*gaugeEntry
+}
+
+// gaugeEntry pairs a registered GaugeVec with the label schema it was built
+// with, so a later poll that observes a different label set can be detected
+// and the vector re-registered instead of panicking on a cardinality mismatch.
+type gaugeEntry struct {
+	vec  *prometheus.GaugeVec
+	keys map[string]bool
+}
+
+// seriesSample is a single ListTimeSeries result reduced to what the gauge
+// needs: its evaluated value and every resource+metric label, none dropped.
+type seriesSample struct {
+	labels prometheus.Labels
+	value  float64
+}
+
+// serve runs the --serve daemon mode: it never returns.
+func serve(ctx context.Context, opts Options) {
+	s := &server{
+		opts:     opts,
+		registry: prometheus.NewRegistry(),
+		gauges:   map[string]*gaugeEntry{},
+	}
+
+	s.poll(ctx)
+	go func() {
+		period := time.Duration(opts.Period) * time.Minute
+		if period <= 0 {
+			period = time.Minute
+		}
+		ticker := time.NewTicker(period)
+		for range ticker.C {
+			s.poll(ctx)
+		}
+	}()
+
+	http.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	log.Fatal(http.ListenAndServe(opts.Serve, nil))
+}
+
+// poll fetches the current time series and updates the matching gauge. It
+// recovers from any panic raised while setting gauge values (e.g. a label
+// set that GaugeVec.With rejects) so one bad tick can't take the whole
+// daemon down.
+func (s *server) poll(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			verbose(s.opts.Verbose, fmt.Sprintf("poll recovered from panic: %v", r))
+		}
+	}()
+
+	c, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		verbose(s.opts.Verbose, err)
+		return
+	}
+
+	filter := metricFilter(s.opts.Metric, s.opts.Filter)
+	req := listTimeSeriesRequest(s.opts.Project, filter, s.opts.Delay, s.opts.Period)
+
+	samples := []seriesSample{}
+	labelKeys := map[string]bool{}
+	it := c.ListTimeSeries(ctx, req)
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			verbose(s.opts.Verbose, err)
+			return
+		}
+
+		labels := mergeLabels(resp.Resource.GetLabels(), resp.Metric.GetLabels())
+		for k := range labels {
+			labelKeys[k] = true
+		}
+		samples = append(samples, seriesSample{
+			labels: labels,
+			value:  evaluate(s.opts.Evalution, resp.ValueType.String(), resp.Points, s.opts.Percentile),
+		})
+	}
+
+	gauge, schemaKeys := s.gaugeFor(s.opts.Metric, labelKeys)
+	for _, sample := range samples {
+		// Fill in any key missing from this sample but present in the
+		// gauge's schema: GaugeVec requires every declared label on every
+		// observation.
+		for k := range schemaKeys {
+			if _, ok := sample.labels[k]; !ok {
+				sample.labels[k] = ""
+			}
+		}
+		gauge.With(sample.labels).Set(sample.value)
+	}
+}
+
+// gaugeFor returns the GaugeVec for a GCP metric type and the label schema it
+// was registered with. GCP metric-level labels can legitimately differ
+// between polls (or even between series in the same poll), so if the
+// observed keys don't match the cached schema, the vector is re-registered
+// with the union of the old and new keys instead of reusing a schema that
+// would panic on With().
+func (s *server) gaugeFor(metricType string, labelKeys map[string]bool) (*prometheus.GaugeVec, map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.gauges[metricType]
+	if ok && sameKeys(entry.keys, labelKeys) {
+		return entry.vec, entry.keys
+	}
+
+	union := map[string]bool{}
+	for k := range labelKeys {
+		union[k] = true
+	}
+	if ok {
+		for k := range entry.keys {
+			union[k] = true
+		}
+		s.registry.Unregister(entry.vec)
+	}
+
+	names := make([]string, 0, len(union))
+	for k := range union {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: promName(metricType),
+		Help: "GCP Cloud Monitoring metric " + metricType,
+	}, names)
+	s.registry.MustRegister(vec)
+	s.gauges[metricType] = &gaugeEntry{vec: vec, keys: union}
+	return vec, union
+}
+
+// sameKeys reports whether two label-key sets are identical.
+func sameKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// promName turns a GCP metric type like
+// "compute.googleapis.com/instance/cpu/utilization" into a Prometheus-friendly
+// metric name.
+func promName(metricType string) string {
+	name := strings.NewReplacer(".", "_", "/", "_", "-", "_").Replace(metricType)
+	return "gcp_" + name
+}
+
+// mergeLabels combines resource and metric labels into a single map so that
+// no label is silently dropped. Metric labels take precedence on collision,
+// matching how Cloud Monitoring itself resolves the (rare) name clash.
+func mergeLabels(resource, metric map[string]string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for k, v := range resource {
+		labels[k] = v
+	}
+	for k, v := range metric {
+		labels[k] = v
+	}
+	return labels
+}